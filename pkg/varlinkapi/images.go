@@ -2,11 +2,14 @@ package varlinkapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +17,7 @@ import (
 	"github.com/containers/buildah/imagebuildah"
 	"github.com/containers/image/docker"
 	dockerarchive "github.com/containers/image/docker/archive"
+	"github.com/containers/image/docker/reference"
 	"github.com/containers/image/manifest"
 	"github.com/containers/image/transports/alltransports"
 	"github.com/containers/image/types"
@@ -22,6 +26,7 @@ import (
 	"github.com/containers/libpod/libpod"
 	"github.com/containers/libpod/libpod/image"
 	sysreg "github.com/containers/libpod/pkg/registries"
+	"github.com/containers/libpod/pkg/trust"
 	"github.com/containers/libpod/pkg/util"
 	"github.com/containers/libpod/utils"
 	"github.com/docker/go-units"
@@ -30,15 +35,147 @@ import (
 	"github.com/pkg/errors"
 )
 
-// ListImages lists all the images in the store
-// It requires no inputs.
-func (i *LibpodAPI) ListImages(call iopodman.VarlinkCall) error {
+// parseImageFilters splits a list of `key=value` filter strings into a key -> values map
+// that matchesImageFilters can evaluate against an image.
+func parseImageFilters(filters []string) (map[string][]string, error) {
+	parsed := make(map[string][]string)
+	for _, f := range filters {
+		pair := strings.SplitN(f, "=", 2)
+		if len(pair) != 2 {
+			return nil, errors.Errorf("invalid filter %q, must be in the form filter=value", f)
+		}
+		parsed[pair[0]] = append(parsed[pair[0]], pair[1])
+	}
+	return parsed, nil
+}
+
+// matchesImageFilters reports whether img satisfies every filter key present in filters,
+// the same dangling=/label=/before=/since=/reference=/readonly=/until= predicates the podman
+// v4 API does. Per Docker/podman semantics, multiple values for the same key are OR'd together
+// (e.g. two reference= values match either one), while distinct keys are AND'd.
+func matchesImageFilters(ctx context.Context, runtime *image.Runtime, img *image.Image, filters map[string][]string) (bool, error) {
+	for key, values := range filters {
+		var (
+			anyMatch bool
+			err      error
+		)
+		switch key {
+		case "dangling":
+			dangling := len(img.Names()) == 0
+			anyMatch, err = matchesAny(values, func(v string) (bool, error) {
+				want, err := strconv.ParseBool(v)
+				if err != nil {
+					return false, errors.Wrapf(err, "invalid dangling filter value %q", v)
+				}
+				return dangling == want, nil
+			})
+		case "label":
+			var labels map[string]string
+			labels, err = img.Labels(ctx)
+			if err == nil {
+				anyMatch, err = matchesAny(values, func(v string) (bool, error) {
+					kv := strings.SplitN(v, "=", 2)
+					label, ok := labels[kv[0]]
+					return ok && (len(kv) != 2 || label == kv[1]), nil
+				})
+			}
+		case "before":
+			anyMatch, err = matchesAny(values, func(v string) (bool, error) {
+				ref, err := runtime.NewFromLocal(v)
+				if err != nil {
+					return false, err
+				}
+				return img.Created().Before(ref.Created()), nil
+			})
+		case "since":
+			anyMatch, err = matchesAny(values, func(v string) (bool, error) {
+				ref, err := runtime.NewFromLocal(v)
+				if err != nil {
+					return false, err
+				}
+				return img.Created().After(ref.Created()), nil
+			})
+		case "reference":
+			anyMatch, err = matchesAny(values, func(v string) (bool, error) {
+				for _, name := range img.Names() {
+					matched, err := reference.FamiliarMatch(v, name)
+					if err != nil {
+						return false, errors.Wrapf(err, "invalid reference filter value %q", v)
+					}
+					if matched {
+						return true, nil
+					}
+				}
+				return false, nil
+			})
+		case "readonly":
+			anyMatch, err = matchesAny(values, func(v string) (bool, error) {
+				want, err := strconv.ParseBool(v)
+				if err != nil {
+					return false, errors.Wrapf(err, "invalid readonly filter value %q", v)
+				}
+				return img.IsReadOnly() == want, nil
+			})
+		case "until":
+			anyMatch, err = matchesAny(values, func(v string) (bool, error) {
+				var cutoff time.Time
+				if d, err := time.ParseDuration(v); err == nil {
+					cutoff = time.Now().Add(-d)
+				} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+					cutoff = t
+				} else {
+					return false, errors.Errorf("invalid until filter value %q, must be a duration or RFC3339 timestamp", v)
+				}
+				return img.Created().Before(cutoff), nil
+			})
+		default:
+			return false, errors.Errorf("unknown filter %q", key)
+		}
+		if err != nil {
+			return false, err
+		}
+		if !anyMatch {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchesAny reports whether pred holds for at least one of values, short-circuiting on the
+// first match or the first error.
+func matchesAny(values []string, pred func(string) (bool, error)) (bool, error) {
+	for _, v := range values {
+		ok, err := pred(v)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListImages lists all the images in the store. An optional set of filters
+// (dangling=, label=, before=, since=, reference=, readonly=, until=) narrows the result.
+func (i *LibpodAPI) ListImages(call iopodman.VarlinkCall, filters []string) error {
+	parsedFilters, err := parseImageFilters(filters)
+	if err != nil {
+		return call.ReplyErrorOccurred(err.Error())
+	}
 	images, err := i.Runtime.ImageRuntime().GetImages()
 	if err != nil {
 		return call.ReplyErrorOccurred(fmt.Sprintf("unable to get list of images %q", err))
 	}
 	var imageList []iopodman.ImageInList
 	for _, image := range images {
+		match, err := matchesImageFilters(getContext(), i.Runtime.ImageRuntime(), image, parsedFilters)
+		if err != nil {
+			return call.ReplyErrorOccurred(err.Error())
+		}
+		if !match {
+			continue
+		}
 		labels, _ := image.Labels(getContext())
 		containers, _ := image.Containers()
 		repoDigests, err := image.RepoDigests()
@@ -326,8 +463,12 @@ func (i *LibpodAPI) HistoryImage(call iopodman.VarlinkCall, name string) error {
 	return call.ReplyHistoryImage(histories)
 }
 
-// PushImage pushes an local image to registry
-func (i *LibpodAPI) PushImage(call iopodman.VarlinkCall, name, tag string, tlsVerify bool, signaturePolicy, creds, certDir string, compress bool, format string, removeSignatures bool, signBy string) error {
+// PushImage pushes an local image to registry. When signOpts.Backend is "gpg" the push is
+// signed the same way as signBy always has been; when it is "sigstore", a sigstore signature
+// is generated from signOpts.KeyPath and attached to the pushed manifest -- the caller must
+// supply signOpts.Passphrase up front if the key is encrypted, since varlink has no way for
+// the server to pause mid-call and read a second answer from the client on the same call.
+func (i *LibpodAPI) PushImage(call iopodman.VarlinkCall, name, tag string, tlsVerify bool, signaturePolicy, creds, certDir string, compress bool, format string, removeSignatures bool, signBy string, signOpts iopodman.SigningOptions) error {
 	var (
 		registryCreds *types.DockerAuthConfig
 		manifestType  string
@@ -371,11 +512,41 @@ func (i *LibpodAPI) PushImage(call iopodman.VarlinkCall, name, tag string, tlsVe
 		RemoveSignatures: removeSignatures,
 		SignBy:           signBy,
 	}
+	if signOpts.Backend == "sigstore" {
+		if signOpts.KeyPath == "" {
+			return call.ReplyErrorOccurred("sigstore signing requested but no key path provided")
+		}
+		so.SigstoreKeyPath = signOpts.KeyPath
+		so.SigstorePassphrase = signOpts.Passphrase
+	}
 
-	if err := newImage.PushImageToHeuristicDestination(getContext(), destname, manifestType, "", signaturePolicy, nil, compress, so, &dockerRegistryOptions, nil); err != nil {
+	if !call.WantsMore() {
+		if err := newImage.PushImageToHeuristicDestination(getContext(), destname, manifestType, "", signaturePolicy, nil, compress, so, &dockerRegistryOptions, nil); err != nil {
+			return call.ReplyErrorOccurred(err.Error())
+		}
+		return call.ReplyPushImage(iopodman.ImageProgress{Id: newImage.ID()})
+	}
+
+	call.Continues = true
+	progress := make(chan types.ProgressProperties)
+	pushErr := make(chan error, 1)
+	go func() {
+		pushErr <- newImage.PushImageToHeuristicDestinationWithProgress(getContext(), destname, manifestType, "", signaturePolicy, compress, so, &dockerRegistryOptions, nil, progress)
+		close(progress)
+	}()
+	for p := range progress {
+		call.ReplyPushImage(iopodman.ImageProgress{
+			ArtifactDigest: p.Artifact.Digest.String(),
+			Offset:         int64(p.Offset),
+			OfferedSize:    int64(p.OfferedSize),
+			Event:          fmt.Sprintf("%v", p.Event),
+		})
+	}
+	call.Continues = false
+	if err := <-pushErr; err != nil {
 		return call.ReplyErrorOccurred(err.Error())
 	}
-	return call.ReplyPushImage(newImage.ID())
+	return call.ReplyPushImage(iopodman.ImageProgress{Id: newImage.ID()})
 }
 
 // TagImage accepts an image name and tag as strings and tags an image in the local store.
@@ -439,15 +610,27 @@ func (i *LibpodAPI) SearchImage(call iopodman.VarlinkCall, name string, limit in
 	return call.ReplySearchImage(imageResults)
 }
 
-// DeleteUnusedImages deletes any images that do not have containers associated with it.
-// TODO Filters are not implemented
-func (i *LibpodAPI) DeleteUnusedImages(call iopodman.VarlinkCall) error {
+// DeleteUnusedImages deletes any images that do not have containers associated with it. An
+// optional set of filters (the same predicates ListImages accepts) narrows which images are
+// considered for deletion.
+func (i *LibpodAPI) DeleteUnusedImages(call iopodman.VarlinkCall, filters []string) error {
+	parsedFilters, err := parseImageFilters(filters)
+	if err != nil {
+		return call.ReplyErrorOccurred(err.Error())
+	}
 	images, err := i.Runtime.ImageRuntime().GetImages()
 	if err != nil {
 		return call.ReplyErrorOccurred(err.Error())
 	}
 	var deletedImages []string
 	for _, img := range images {
+		match, err := matchesImageFilters(getContext(), i.Runtime.ImageRuntime(), img, parsedFilters)
+		if err != nil {
+			return call.ReplyErrorOccurred(err.Error())
+		}
+		if !match {
+			continue
+		}
 		containers, err := img.Containers()
 		if err != nil {
 			return call.ReplyErrorOccurred(err.Error())
@@ -538,8 +721,12 @@ func (i *LibpodAPI) ExportImage(call iopodman.VarlinkCall, name, destination str
 	return call.ReplyExportImage(newImage.ID())
 }
 
-// PullImage pulls an image from a registry to the image store.
-func (i *LibpodAPI) PullImage(call iopodman.VarlinkCall, name string, certDir, creds, signaturePolicy string, tlsVerify bool) error {
+// PullImage pulls an image from a registry to the image store. When policyFragment is set it
+// is merged on top of signaturePolicy (or the default policy.json when signaturePolicy is
+// empty) and images whose signatures don't satisfy the resulting policy are rejected with a
+// SignatureVerificationFailed error. A docker-archive: pull returns its load error as is, not
+// SignatureVerificationFailed.
+func (i *LibpodAPI) PullImage(call iopodman.VarlinkCall, name string, certDir, creds, signaturePolicy string, tlsVerify bool, policyFragment string) error {
 	var (
 		registryCreds *types.DockerAuthConfig
 		imageID       string
@@ -560,6 +747,16 @@ func (i *LibpodAPI) PullImage(call iopodman.VarlinkCall, name string, certDir, c
 		dockerRegistryOptions.DockerInsecureSkipTLSVerify = types.NewOptionalBool(!tlsVerify)
 	}
 
+	effectivePolicy := signaturePolicy
+	if policyFragment != "" {
+		mergedPolicy, err := writeMergedPolicy(signaturePolicy, policyFragment)
+		if err != nil {
+			return call.ReplyErrorOccurred(err.Error())
+		}
+		defer os.Remove(mergedPolicy)
+		effectivePolicy = mergedPolicy
+	}
+
 	so := image.SigningOptions{}
 
 	if strings.HasPrefix(name, dockerarchive.Transport.Name()+":") {
@@ -567,19 +764,103 @@ func (i *LibpodAPI) PullImage(call iopodman.VarlinkCall, name string, certDir, c
 		if err != nil {
 			return errors.Wrapf(err, "error parsing %q", name)
 		}
-		newImage, err := i.Runtime.ImageRuntime().LoadFromArchiveReference(getContext(), srcRef, signaturePolicy, nil)
+		newImage, err := i.Runtime.ImageRuntime().LoadFromArchiveReference(getContext(), srcRef, effectivePolicy, nil)
 		if err != nil {
 			return errors.Wrapf(err, "error pulling image from %q", name)
 		}
 		imageID = newImage[0].ID()
+	} else if call.WantsMore() {
+		call.Continues = true
+		progress := make(chan types.ProgressProperties)
+		pullErr := make(chan error, 1)
+		go func() {
+			newImage, err := i.Runtime.ImageRuntime().NewWithProgress(getContext(), name, effectivePolicy, "", &dockerRegistryOptions, so, false, progress)
+			if newImage != nil {
+				imageID = newImage.ID()
+			}
+			pullErr <- err
+			close(progress)
+		}()
+		for p := range progress {
+			call.ReplyPullImage(iopodman.ImageProgress{
+				ArtifactDigest: p.Artifact.Digest.String(),
+				Offset:         int64(p.Offset),
+				OfferedSize:    int64(p.OfferedSize),
+				Event:          fmt.Sprintf("%v", p.Event),
+			})
+		}
+		call.Continues = false
+		if err := <-pullErr; err != nil {
+			return replyPullError(call, name, err)
+		}
 	} else {
-		newImage, err := i.Runtime.ImageRuntime().New(getContext(), name, signaturePolicy, "", nil, &dockerRegistryOptions, so, false)
+		newImage, err := i.Runtime.ImageRuntime().New(getContext(), name, effectivePolicy, "", nil, &dockerRegistryOptions, so, false)
 		if err != nil {
-			return call.ReplyErrorOccurred(fmt.Sprintf("unable to pull %s: %s", name, err.Error()))
+			return replyPullError(call, name, err)
 		}
 		imageID = newImage.ID()
 	}
-	return call.ReplyPullImage(imageID)
+	return call.ReplyPullImage(iopodman.ImageProgress{Id: imageID})
+}
+
+// replyPullError maps a pull failure to the structured SignatureVerificationFailed reply
+// when it was a signature policy violation, or the generic error reply otherwise.
+func replyPullError(call iopodman.VarlinkCall, name string, err error) error {
+	if sigErr, ok := errors.Cause(err).(image.ErrSignatureValidationFailed); ok {
+		return call.ReplySignatureVerificationFailed(name, sigErr.Identities, sigErr.Error())
+	}
+	return call.ReplyErrorOccurred(fmt.Sprintf("unable to pull %s: %s", name, err.Error()))
+}
+
+// writeMergedPolicy overlays policyFragment (a JSON object describing additional scopes, e.g.
+// {"transports":{"docker":{"example.com/repo":[...]}}}) on top of basePolicyPath (or the
+// default policy.json when empty) and returns the path to a temporary file holding the merged
+// policy, ready to be handed to containers/image as a signaturePolicy path.
+func writeMergedPolicy(basePolicyPath, policyFragment string) (string, error) {
+	if basePolicyPath == "" {
+		basePolicyPath = trust.DefaultPolicyPath
+	}
+	base, err := ioutil.ReadFile(basePolicyPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to read signature policy %q", basePolicyPath)
+	}
+	var basePolicy, fragment map[string]interface{}
+	if err := json.Unmarshal(base, &basePolicy); err != nil {
+		return "", errors.Wrap(err, "unable to parse signature policy")
+	}
+	if err := json.Unmarshal([]byte(policyFragment), &fragment); err != nil {
+		return "", errors.Wrap(err, "unable to parse policy fragment")
+	}
+	mergeJSONObjects(basePolicy, fragment)
+	merged, err := json.Marshal(basePolicy)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile("", "libpod-policy")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(merged); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// mergeJSONObjects merges fragment into base in place, recursing into any key present as a
+// JSON object on both sides (e.g. "transports"."docker"."example.com/repo") instead of letting
+// a fragment key blow away the whole object underneath it -- a fragment naming one registry's
+// scope under "transports"."docker" must not drop every other registry's trust configuration.
+func mergeJSONObjects(base, fragment map[string]interface{}) {
+	for k, v := range fragment {
+		fragmentChild, fragmentIsObject := v.(map[string]interface{})
+		baseChild, baseIsObject := base[k].(map[string]interface{})
+		if fragmentIsObject && baseIsObject {
+			mergeJSONObjects(baseChild, fragmentChild)
+			continue
+		}
+		base[k] = v
+	}
 }
 
 // ImageExists returns bool as to whether the input image exists in local storage
@@ -643,3 +924,465 @@ func (i *LibpodAPI) ImagesPrune(call iopodman.VarlinkCall) error {
 	}
 	return call.ReplyImagesPrune(pruned)
 }
+
+// ImagesPruneWithFilters prunes unused images the same way ImagesPrune does, but restricts
+// the candidate set to images matching filters (dangling=, label=, before=, since=,
+// reference=, readonly=, until=) before anything is removed.
+func (i *LibpodAPI) ImagesPruneWithFilters(call iopodman.VarlinkCall, filters []string) error {
+	parsedFilters, err := parseImageFilters(filters)
+	if err != nil {
+		return call.ReplyErrorOccurred(err.Error())
+	}
+	pruneImages, err := i.Runtime.ImageRuntime().GetPruneImages()
+	if err != nil {
+		return err
+	}
+	var pruned []string
+	for _, img := range pruneImages {
+		match, err := matchesImageFilters(getContext(), i.Runtime.ImageRuntime(), img, parsedFilters)
+		if err != nil {
+			return call.ReplyErrorOccurred(err.Error())
+		}
+		if !match {
+			continue
+		}
+		if err := img.Remove(true); err != nil {
+			return call.ReplyErrorOccurred(err.Error())
+		}
+		pruned = append(pruned, img.ID())
+	}
+	return call.ReplyImagesPruneWithFilters(pruned)
+}
+
+// ManifestCreate creates a new manifest list that can be filled in with ManifestAdd. The
+// optional images are resolved locally and added as entries, the same as calling ManifestAdd
+// for each one individually.
+func (i *LibpodAPI) ManifestCreate(call iopodman.VarlinkCall, names, images []string, all bool) error {
+	imageID, err := image.CreateManifestList(i.Runtime.ImageRuntime(), getContext(), names, images, all)
+	if err != nil {
+		return call.ReplyErrorOccurred(err.Error())
+	}
+	return call.ReplyManifestCreate(imageID)
+}
+
+// ManifestInspect returns the content of a manifest list or image index as a JSON string,
+// suitable for the same consumption as `podman manifest inspect`.
+func (i *LibpodAPI) ManifestInspect(call iopodman.VarlinkCall, name string) error {
+	newImage, err := i.Runtime.ImageRuntime().NewFromLocal(name)
+	if err != nil {
+		return call.ReplyImageNotFound(name)
+	}
+	data, err := image.GetManifestListData(getContext(), newImage)
+	if err != nil {
+		return call.ReplyErrorOccurred(err.Error())
+	}
+	b, err := json.MarshalIndent(data, "", "    ")
+	if err != nil {
+		return call.ReplyErrorOccurred(fmt.Sprintf("unable to serialize %q", err))
+	}
+	return call.ReplyManifestInspect(string(b))
+}
+
+// ManifestAdd adds an image, or an image pulled by digest from a per-arch source, as an entry
+// in the named manifest list. The architecture/os/os.version/variant/features of the entry can
+// be overridden in opts; when left blank they are inspected from the added image itself.
+func (i *LibpodAPI) ManifestAdd(call iopodman.VarlinkCall, opts iopodman.ManifestAddOpts) error {
+	registryOpts := image.DockerRegistryOptions{
+		DockerCertPath: opts.CertDir,
+	}
+	if !opts.TlsVerify {
+		registryOpts.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+	if opts.Creds != "" {
+		creds, err := util.ParseRegistryCreds(opts.Creds)
+		if err != nil {
+			return err
+		}
+		registryOpts.DockerRegistryCreds = creds
+	}
+	newImageID, err := image.AddToManifestList(getContext(), i.Runtime.ImageRuntime(), image.ManifestAddOptions{
+		Name:         opts.Name,
+		Images:       opts.Images,
+		All:          opts.All,
+		Arch:         opts.Arch,
+		OS:           opts.Os,
+		OSVersion:    opts.Os_version,
+		Variant:      opts.Variant,
+		Features:     opts.Features,
+		Annotations:  opts.Annotation,
+		RegistryOpts: registryOpts,
+	})
+	if err != nil {
+		return call.ReplyErrorOccurred(err.Error())
+	}
+	return call.ReplyManifestAdd(newImageID)
+}
+
+// ManifestAnnotate updates the architecture/os/os.version/variant/features/annotations
+// recorded against a single digest already present in the named manifest list.
+func (i *LibpodAPI) ManifestAnnotate(call iopodman.VarlinkCall, name, digest string, opts iopodman.ManifestAnnotateOpts) error {
+	newImageID, err := image.AnnotateManifestList(getContext(), i.Runtime.ImageRuntime(), name, digest, image.ManifestAnnotateOptions{
+		Arch:        opts.Arch,
+		OS:          opts.Os,
+		OSVersion:   opts.Os_version,
+		Variant:     opts.Variant,
+		Features:    opts.Features,
+		Annotations: opts.Annotation,
+	})
+	if err != nil {
+		return call.ReplyErrorOccurred(err.Error())
+	}
+	return call.ReplyManifestAnnotate(newImageID)
+}
+
+// ManifestRemove drops a single digest from the named manifest list and returns the
+// resulting list's image ID.
+func (i *LibpodAPI) ManifestRemove(call iopodman.VarlinkCall, name, digest string) error {
+	newImageID, err := image.RemoveFromManifestList(i.Runtime.ImageRuntime(), name, digest)
+	if err != nil {
+		return call.ReplyErrorOccurred(err.Error())
+	}
+	return call.ReplyManifestRemove(newImageID)
+}
+
+// ManifestPush pushes either the manifest list itself, or every image referenced by it,
+// to destination. Set all to push the full list of per-arch images along with the index.
+func (i *LibpodAPI) ManifestPush(call iopodman.VarlinkCall, name, destination string, tlsVerify bool, creds, certDir, digestFile, signaturePolicy string, removeSignatures bool, signBy string, all bool) error {
+	var registryCreds *types.DockerAuthConfig
+	if creds != "" {
+		parsedCreds, err := util.ParseRegistryCreds(creds)
+		if err != nil {
+			return err
+		}
+		registryCreds = parsedCreds
+	}
+	dockerRegistryOptions := image.DockerRegistryOptions{
+		DockerRegistryCreds: registryCreds,
+		DockerCertPath:      certDir,
+	}
+	if !tlsVerify {
+		dockerRegistryOptions.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+	so := image.SigningOptions{
+		RemoveSignatures: removeSignatures,
+		SignBy:           signBy,
+	}
+	digest, err := image.PushManifestList(getContext(), i.Runtime.ImageRuntime(), name, destination, digestFile, signaturePolicy, so, &dockerRegistryOptions, all)
+	if err != nil {
+		return call.ReplyErrorOccurred(err.Error())
+	}
+	return call.ReplyManifestPush(digest)
+}
+
+// TrustShow returns the trust policy scopes (default, per-registry, per-repo) that PullImage
+// consults when verifying signatures, as recorded in the system's policy.json.
+func (i *LibpodAPI) TrustShow(call iopodman.VarlinkCall) error {
+	policyContent, err := trust.GetPolicy(trust.DefaultPolicyPath)
+	if err != nil {
+		return call.ReplyErrorOccurred(fmt.Sprintf("unable to read trust policy: %q", err))
+	}
+	showInfo, err := trust.PolicyDescriptionsFromContent(policyContent)
+	if err != nil {
+		return call.ReplyErrorOccurred(err.Error())
+	}
+	var reply []iopodman.ImageTrustShow
+	for _, info := range showInfo {
+		reply = append(reply, iopodman.ImageTrustShow{
+			Reponame:  info.Name,
+			Trusttype: info.Type,
+			Gpgid:     info.GPGId,
+		})
+	}
+	return call.ReplyTrustShow(reply)
+}
+
+// TrustSet adds or replaces the trust policy entry for scope (a registry, a repo, or "default")
+// with the given trust type ("accept", "reject", or "signedBy") and, for signedBy, the GPG
+// key IDs or sigstore key path that must sign matching images.
+func (i *LibpodAPI) TrustSet(call iopodman.VarlinkCall, scope, trustType string, keys []string) error {
+	policyContent, err := trust.GetPolicy(trust.DefaultPolicyPath)
+	if err != nil {
+		return call.ReplyErrorOccurred(fmt.Sprintf("unable to read trust policy: %q", err))
+	}
+	if err := trust.AddPolicyEntry(policyContent, scope, trustType, keys); err != nil {
+		return call.ReplyErrorOccurred(err.Error())
+	}
+	if err := trust.SavePolicy(trust.DefaultPolicyPath, policyContent); err != nil {
+		return call.ReplyErrorOccurred(err.Error())
+	}
+	return call.ReplyTrustSet()
+}
+
+const (
+	autoUpdateLabel         = "io.containers.autoupdate"
+	autoUpdateAuthfileLabel = "io.containers.autoupdate.authfile"
+	autoUpdateUnitLabel     = "io.containers.autoupdate.systemd-unit"
+
+	autoUpdateRegistry = "registry"
+	autoUpdateLocal    = "local"
+)
+
+// AutoUpdate walks all local containers carrying an io.containers.autoupdate label. For
+// policy "registry" it re-pulls the newest image from the source registry; for "local" it
+// re-resolves imageName against local storage, so a container whose image was reloaded or
+// retagged out-of-band is also picked up. Either way, the comparison is always against the
+// digest the container was actually created with (its RootfsImageID), not against whatever
+// imageName happens to resolve to right now -- that running digest is what lets the "local"
+// policy detect a real change instead of always comparing an image against itself. When the
+// digest changed, the container is recreated against the new image, or, when
+// io.containers.autoupdate.systemd-unit is set, that unit is restarted instead. Recreated
+// containers that fail a subsequent health check are rolled back to the previous image; a
+// restarted systemd unit is not health-checked or rolled back.
+func (i *LibpodAPI) AutoUpdate(call iopodman.VarlinkCall) error {
+	ctx := getContext()
+	containers, err := i.Runtime.GetAllContainers()
+	if err != nil {
+		return call.ReplyErrorOccurred(err.Error())
+	}
+	var reports []iopodman.AutoUpdateReport
+	for _, ctr := range containers {
+		labels := ctr.Labels()
+		policy := labels[autoUpdateLabel]
+		if policy != autoUpdateRegistry && policy != autoUpdateLocal {
+			continue
+		}
+
+		imageName := ctr.Config().RootfsImageName
+		report := iopodman.AutoUpdateReport{
+			Container: ctr.ID(),
+			Image:     imageName,
+		}
+
+		runningImage, err := i.Runtime.ImageRuntime().NewFromLocal(ctr.Config().RootfsImageID)
+		if err != nil {
+			report.Error = err.Error()
+			reports = append(reports, report)
+			continue
+		}
+		oldDigest, err := runningImage.Digest(ctx)
+		if err != nil {
+			report.Error = err.Error()
+			reports = append(reports, report)
+			continue
+		}
+		report.OldDigest = oldDigest.String()
+
+		var newImage *image.Image
+		if policy == autoUpdateLocal {
+			newImage, err = i.Runtime.ImageRuntime().NewFromLocal(imageName)
+		} else {
+			authfile := labels[autoUpdateAuthfileLabel]
+			newImage, err = i.Runtime.ImageRuntime().New(ctx, imageName, "", authfile, nil, &image.DockerRegistryOptions{}, image.SigningOptions{}, true)
+		}
+		if err != nil {
+			report.Error = err.Error()
+			reports = append(reports, report)
+			continue
+		}
+		newDigest, err := newImage.Digest(ctx)
+		if err != nil {
+			report.Error = err.Error()
+			reports = append(reports, report)
+			continue
+		}
+		report.NewDigest = newDigest.String()
+		if newDigest == oldDigest {
+			reports = append(reports, report)
+			continue
+		}
+
+		if unit := labels[autoUpdateUnitLabel]; unit != "" {
+			if err := utils.RestartSystemdUnit(unit); err != nil {
+				report.Error = err.Error()
+				reports = append(reports, report)
+				continue
+			}
+			report.Updated = true
+			reports = append(reports, report)
+			continue
+		}
+
+		newCtr, err := recreateContainerWithImage(ctx, i.Runtime, ctr, newImage)
+		if err != nil {
+			report.Error = err.Error()
+			reports = append(reports, report)
+			continue
+		}
+		if err := waitForHealthy(ctx, newCtr); err != nil {
+			report.Error = fmt.Sprintf("container failed health check after update, rolling back: %v", err)
+			if _, rollbackErr := recreateContainerWithImage(ctx, i.Runtime, newCtr, runningImage); rollbackErr == nil {
+				report.RolledBack = true
+			}
+			reports = append(reports, report)
+			continue
+		}
+		report.Updated = true
+		reports = append(reports, report)
+	}
+	return call.ReplyAutoUpdate(reports)
+}
+
+// recreateContainerWithImage stops ctr, renames it aside, and creates + starts a replacement
+// container from the same create config but targeting newImage -- the same swap-by-recreation
+// approach `podman auto-update` uses, since restarting ctr in place would just rerun the image
+// it already has. The original container is removed once the replacement starts successfully;
+// on any failure along the way the original is renamed back and restarted so a failed update
+// never leaves the workload down.
+func recreateContainerWithImage(ctx context.Context, runtime *libpod.Runtime, ctr *libpod.Container, newImage *image.Image) (*libpod.Container, error) {
+	createConfig := ctr.Config()
+	createConfig.RootfsImageID = newImage.ID()
+	if names := newImage.Names(); len(names) > 0 {
+		createConfig.RootfsImageName = names[0]
+	}
+
+	if err := ctr.Stop(); err != nil && errors.Cause(err) != libpod.ErrCtrStopped {
+		return nil, err
+	}
+
+	oldName := ctr.Name()
+	tmpName := oldName + "_old"
+	if err := runtime.RenameContainer(ctx, ctr, tmpName); err != nil {
+		_ = ctr.Start(ctx)
+		return nil, err
+	}
+
+	newCtr, err := runtime.NewContainerFromSpec(ctx, createConfig)
+	if err != nil {
+		_ = runtime.RenameContainer(ctx, ctr, oldName)
+		_ = ctr.Start(ctx)
+		return nil, err
+	}
+
+	if err := newCtr.Start(ctx); err != nil {
+		_ = runtime.RemoveContainer(ctx, newCtr, true, false)
+		_ = runtime.RenameContainer(ctx, ctr, oldName)
+		_ = ctr.Start(ctx)
+		return nil, err
+	}
+
+	if err := runtime.RemoveContainer(ctx, ctr, true, false); err != nil {
+		return newCtr, err
+	}
+	return newCtr, nil
+}
+
+// waitForHealthy reports an error if ctr defines a healthcheck and it doesn't report healthy
+// shortly after a restart.
+func waitForHealthy(ctx context.Context, ctr *libpod.Container) error {
+	if !ctr.HasHealthCheck() {
+		return nil
+	}
+	status, err := ctr.HealthCheck(ctx)
+	if err != nil {
+		return err
+	}
+	if status != libpod.HealthCheckSuccess {
+		return errors.Errorf("container %s is unhealthy", ctr.ID())
+	}
+	return nil
+}
+
+// ImageTree returns the per-layer history of an image as a nested ImageTreeNode chain, one
+// node per layer (digest, size, CreatedBy), tagged at its top-most layer -- the same data
+// `podman image tree` renders locally. By default the chain continues past the image's base
+// layer into its parent image's own layers (ancestry); when whatRequires is true, it instead
+// branches at the image's top layer into the layer chain of every locally stored image built
+// on top of it (dependents), since more than one image can share the same base.
+func (i *LibpodAPI) ImageTree(call iopodman.VarlinkCall, name string, whatRequires bool) error {
+	img, err := i.Runtime.ImageRuntime().NewFromLocal(name)
+	if err != nil {
+		return call.ReplyImageNotFound(name)
+	}
+	allImages, err := i.Runtime.ImageRuntime().GetImages()
+	if err != nil {
+		return call.ReplyErrorOccurred(err.Error())
+	}
+	root, err := buildImageTreeChain(getContext(), img, allImages, whatRequires)
+	if err != nil {
+		return call.ReplyErrorOccurred(err.Error())
+	}
+	return call.ReplyImageTree(*root)
+}
+
+// buildImageTreeChain builds img's own layer chain, then grafts on either its parent image's
+// chain (ancestry) or every dependent image's chain (whatRequires), each built the same way.
+func buildImageTreeChain(ctx context.Context, img *image.Image, allImages []*image.Image, whatRequires bool) (*iopodman.ImageTreeNode, error) {
+	root, leaf, err := imageLayerChain(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+
+	if whatRequires {
+		for _, candidate := range allImages {
+			if candidate.Parent != img.ID() {
+				continue
+			}
+			childRoot, err := buildImageTreeChain(ctx, candidate, allImages, whatRequires)
+			if err != nil {
+				return nil, err
+			}
+			leaf.Children = append(leaf.Children, *childRoot)
+		}
+		return root, nil
+	}
+
+	if img.Parent == "" {
+		return root, nil
+	}
+	for _, candidate := range allImages {
+		if candidate.ID() != img.Parent {
+			continue
+		}
+		parentRoot, err := buildImageTreeChain(ctx, candidate, allImages, whatRequires)
+		if err != nil {
+			return nil, err
+		}
+		// Graft img's own chain onto the parent's deepest node so the returned tree is
+		// rooted at the furthest ancestor, descending through the parent's layers and
+		// then img's own layers.
+		deepestNode(parentRoot).Children = append(deepestNode(parentRoot).Children, *root)
+		return parentRoot, nil
+	}
+	return root, nil
+}
+
+// imageLayerChain builds the linear ImageTreeNode chain for img's own history (oldest layer
+// first), returning both the chain's root and its leaf -- the image's top, tagged layer -- so
+// callers can graft ancestor or dependent chains onto either end.
+func imageLayerChain(ctx context.Context, img *image.Image) (root, leaf *iopodman.ImageTreeNode, err error) {
+	history, err := img.History(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(history) == 0 {
+		return nil, nil, errors.Errorf("image %s has no history", img.ID())
+	}
+	for idx := len(history) - 1; idx >= 0; idx-- {
+		h := history[idx]
+		node := iopodman.ImageTreeNode{
+			Layer:     h.ID,
+			Size:      h.Size,
+			CreatedBy: h.CreatedBy,
+		}
+		if idx == 0 {
+			node.Tags = img.Names()
+		}
+		if root == nil {
+			root = &node
+			leaf = root
+			continue
+		}
+		leaf.Children = append(leaf.Children, node)
+		leaf = &leaf.Children[len(leaf.Children)-1]
+	}
+	return root, leaf, nil
+}
+
+// deepestNode walks n's last child repeatedly to find the bottom of a linear chain built by
+// imageLayerChain, so a further chain can be grafted onto its true leaf.
+func deepestNode(n *iopodman.ImageTreeNode) *iopodman.ImageTreeNode {
+	for len(n.Children) > 0 {
+		n = &n.Children[len(n.Children)-1]
+	}
+	return n
+}